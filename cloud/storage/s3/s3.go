@@ -8,7 +8,16 @@ package s3 // import "aws.upspin.io/cloud/storage/s3"
 
 import (
 	"bytes"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
@@ -18,10 +27,15 @@ import (
 
 	"upspin.io/cloud/storage"
 	"upspin.io/errors"
+	"upspin.io/log"
 )
 
-// These constants define ACLs for writing data to Amazon Simple Storage
-// Service. Definitions according to
+// maxDeleteBatch is the maximum number of keys S3 accepts in a single
+// DeleteObjects call.
+const maxDeleteBatch = 1000
+
+// These constants define the canned ACLs accepted for writing data to
+// Amazon Simple Storage Service. Definitions according to
 // http://docs.aws.amazon.com/AmazonS3/latest/dev/acl-overview.html#canned-acl
 const (
 	// ACLPublicRead means owner gets FULL_CONTROL.
@@ -30,23 +44,95 @@ const (
 	// ACLPrivate means owner gets FULL_CONTROL.
 	// No one else has access rights.
 	ACLPrivate = "private"
+	// ACLBucketOwnerFullControl means both the object writer and the
+	// bucket owner get FULL_CONTROL over the object.
+	ACLBucketOwnerFullControl = "bucket-owner-full-control"
+	// ACLAuthenticatedRead means owner gets FULL_CONTROL, and any
+	// authenticated AWS user gets READ access.
+	ACLAuthenticatedRead = "authenticated-read"
+	// ACLBucketOwnerRead means the object writer gets FULL_CONTROL, and
+	// the bucket owner gets READ access.
+	ACLBucketOwnerRead = "bucket-owner-read"
+)
+
+// cannedACLs is the full set of canned ACLs accepted by the defaultACL
+// dial option.
+var cannedACLs = map[string]bool{
+	ACLPrivate:                true,
+	ACLPublicRead:             true,
+	ACLBucketOwnerFullControl: true,
+	ACLAuthenticatedRead:      true,
+	ACLBucketOwnerRead:        true,
+	"public-read-write":       true,
+	"aws-exec-read":           true,
+	"log-delivery-write":      true,
+}
+
+// These constants define the server-side encryption modes accepted by the
+// s3SSE dial option.
+const (
+	// SSES3 encrypts objects with keys managed by S3.
+	SSES3 = s3.ServerSideEncryptionAes256
+	// SSEKMS encrypts objects with a key managed by AWS KMS.
+	SSEKMS = s3.ServerSideEncryptionAwsKms
 )
 
 // Keys used for storing dial options.
 const (
-	regionName  = "s3Region"
-	bucketName  = "s3BucketName"
-	defaultACL  = "defaultACL"
-	endpointURL = "endpoint"
-	pathstyle   = "pathstyle"
+	regionName            = "s3Region"
+	bucketName            = "s3BucketName"
+	defaultACL            = "defaultACL"
+	endpointURL           = "endpoint"
+	pathstyle             = "pathstyle"
+	sseName               = "s3SSE"
+	kmsKeyIDKey           = "s3KMSKeyID"
+	bufferDirName         = "s3BufferDir"
+	bufferMaxBytesName    = "s3BufferMaxBytes"
+	uploadWorkersName     = "s3UploadWorkers"
+	uploadConcurrencyName = "s3UploadConcurrency"
+	uploadPartSizeName    = "s3UploadPartSize"
 )
 
+// defaultUploadWorkers is used when s3UploadWorkers is not set but
+// s3BufferDir is: it is the number of background goroutines draining the
+// buffered upload queue.
+const defaultUploadWorkers = 5
+
 // s3Impl is an implementation of Storage that connects to an Amazon Simple
 // Storage (S3) backend.
 type s3Impl struct {
 	service         *s3.S3
 	bucketName      string
 	defaultWriteACL string
+	sse             string
+	kmsKeyID        string
+
+	// The following implement the optional disk-buffered, retrying
+	// upload path used when bufferDir is non-empty. See Put and
+	// UploadStats.
+	bufferDir      string
+	bufferMaxBytes int64
+
+	// uploadWorkers is the number of background goroutines draining the
+	// buffered upload queue. uploadConcurrency and uploadPartSize
+	// configure each individual s3manager.Uploader's multipart
+	// fan-out; they are independent of uploadWorkers, so
+	// s3UploadWorkers * s3UploadConcurrency bounds the total number of
+	// concurrent S3 connections.
+	uploadWorkers     int
+	uploadConcurrency int
+	uploadPartSize    int64
+
+	jobs sync.WaitGroup // outstanding upload jobs, for a graceful Close.
+	work chan *uploadJob
+
+	mu            sync.Mutex // guards bytesInFlight and budget waiters.
+	cond          *sync.Cond
+	bytesInFlight int64
+
+	queueDepth        int64 // atomic: jobs waiting for or undergoing upload.
+	retries           int64 // atomic: number of upload attempts that were retried.
+	permanentFailures int64 // atomic: jobs that exhausted retries and were dropped.
 }
 
 // New initializes a Storage implementation that stores data to Amazon Simple
@@ -83,9 +169,61 @@ func New(opts *storage.Opts) (storage.Storage, error) {
 	} else {
 		return nil, errors.E(op, errors.Invalid, errors.Errorf("%q must be true or false", pathstyle))
 	}
-	if acl != ACLPrivate && acl != ACLPublicRead {
+	if !cannedACLs[acl] {
+		return nil, errors.E(op, errors.Invalid, errors.Errorf("%q is not a valid S3 canned ACL", acl))
+	}
+
+	sse := opts.Opts[sseName]
+	switch sse {
+	case "", SSES3, SSEKMS:
+		// OK.
+	default:
+		return nil, errors.E(op, errors.Invalid,
+			errors.Errorf("%q must be empty, %q, or %q", sseName, SSES3, SSEKMS))
+	}
+	kmsKeyID := opts.Opts[kmsKeyIDKey]
+	if sse == SSEKMS && kmsKeyID == "" {
 		return nil, errors.E(op, errors.Invalid,
-			errors.Errorf("valid ACL values for S3 are %s and %s", ACLPrivate, ACLPublicRead))
+			errors.Errorf("%q is required when %q is %q", kmsKeyIDKey, sseName, SSEKMS))
+	}
+
+	bufferDir := opts.Opts[bufferDirName]
+	var bufferMaxBytes int64
+	var uploadWorkers, uploadConcurrency int
+	var uploadPartSize int64
+	if bufferDir != "" {
+		if s, ok := opts.Opts[bufferMaxBytesName]; ok {
+			n, err := strconv.ParseInt(s, 10, 64)
+			if err != nil || n < 0 {
+				return nil, errors.E(op, errors.Invalid, errors.Errorf("%q must be a non-negative integer", bufferMaxBytesName))
+			}
+			bufferMaxBytes = n
+		}
+		uploadWorkers = defaultUploadWorkers
+		if s, ok := opts.Opts[uploadWorkersName]; ok {
+			n, err := strconv.Atoi(s)
+			if err != nil || n <= 0 {
+				return nil, errors.E(op, errors.Invalid, errors.Errorf("%q must be a positive integer", uploadWorkersName))
+			}
+			uploadWorkers = n
+		}
+		if s, ok := opts.Opts[uploadConcurrencyName]; ok {
+			n, err := strconv.Atoi(s)
+			if err != nil || n <= 0 {
+				return nil, errors.E(op, errors.Invalid, errors.Errorf("%q must be a positive integer", uploadConcurrencyName))
+			}
+			uploadConcurrency = n
+		}
+		if s, ok := opts.Opts[uploadPartSizeName]; ok {
+			n, err := strconv.ParseInt(s, 10, 64)
+			if err != nil || n < s3manager.MinUploadPartSize {
+				return nil, errors.E(op, errors.Invalid, errors.Errorf("%q must be an integer of at least %d bytes", uploadPartSizeName, s3manager.MinUploadPartSize))
+			}
+			uploadPartSize = n
+		}
+		if err := os.MkdirAll(bufferDir, 0700); err != nil {
+			return nil, errors.E(op, errors.IO, errors.Errorf("unable to create buffer dir %q: %s", bufferDir, err))
+		}
 	}
 
 	sess, err := session.NewSessionWithOptions(session.Options{
@@ -96,11 +234,65 @@ func New(opts *storage.Opts) (storage.Storage, error) {
 		return nil, errors.E(op, errors.IO, errors.Errorf("unable to create Amazon session: %s", err))
 	}
 
-	return &s3Impl{
-		service:         s3.New(sess),
-		bucketName:      bucket,
-		defaultWriteACL: acl,
-	}, nil
+	s := &s3Impl{
+		service:           s3.New(sess),
+		bucketName:        bucket,
+		defaultWriteACL:   acl,
+		sse:               sse,
+		kmsKeyID:          kmsKeyID,
+		bufferDir:         bufferDir,
+		bufferMaxBytes:    bufferMaxBytes,
+		uploadWorkers:     uploadWorkers,
+		uploadConcurrency: uploadConcurrency,
+		uploadPartSize:    uploadPartSize,
+	}
+	s.cond = sync.NewCond(&s.mu)
+	if bufferDir != "" {
+		s.work = make(chan *uploadJob, uploadWorkers)
+		for i := 0; i < uploadWorkers; i++ {
+			go s.uploadWorker()
+		}
+		if err := s.replayBufferDir(); err != nil {
+			// Shut down the workers we just started rather than leaking
+			// them along with the s3 session, since s itself is about
+			// to be discarded.
+			close(s.work)
+			s.jobs.Wait()
+			return nil, errors.E(op, errors.IO, errors.Errorf("unable to replay buffer dir %q: %s", bufferDir, err))
+		}
+	}
+	return s, nil
+}
+
+// replayBufferDir re-enqueues any buffer files left behind by a previous,
+// unclean shutdown (crash, kill, OOM) between Put staging a file and its
+// uploadWorker finishing with it, so queued writes the caller already
+// believes durable are not silently dropped on restart.
+func (s *s3Impl) replayBufferDir() error {
+	entries, err := ioutil.ReadDir(s.bufferDir)
+	if err != nil {
+		return err
+	}
+	for _, fi := range entries {
+		if fi.IsDir() {
+			continue
+		}
+		ref, ok := parseBufferFileName(fi.Name())
+		if !ok {
+			continue
+		}
+		path := filepath.Join(s.bufferDir, fi.Name())
+		size := fi.Size()
+		if err := s.acquireBudget(size); err != nil {
+			log.Printf("cloud/storage/amazons3: dropping orphaned buffer file %q, too large to replay: %s", fi.Name(), err)
+			os.Remove(path)
+			continue
+		}
+		atomic.AddInt64(&s.queueDepth, 1)
+		s.jobs.Add(1)
+		s.work <- &uploadJob{ref: ref, path: path, size: size}
+	}
+	return nil
 }
 
 func init() {
@@ -115,7 +307,9 @@ func (s *s3Impl) LinkBase() (base string, err error) {
 	return s.service.Endpoint + "/" + s.bucketName + "/", nil
 }
 
-// Download implements Storage.
+// Download implements Storage. Server-side encrypted objects, whether
+// SSE-S3 or SSE-KMS, are decrypted transparently by S3 as long as the
+// caller is authorized to use the key.
 func (s *s3Impl) Download(ref string) ([]byte, error) {
 	const op errors.Op = "cloud/storage/amazons3.Download"
 
@@ -135,24 +329,220 @@ func (s *s3Impl) Download(ref string) ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
-// Put implements Storage.
+// Put implements Storage. If the backend was dialed with s3BufferDir set,
+// Put stages contents to a file under that directory and returns once the
+// file is safely on disk; the upload to S3 itself happens on a background
+// worker, with retries, so a burst of writes doesn't block callers on S3
+// latency. A job that exhausts its retries is counted in UploadStats'
+// PermanentFailures rather than silently dropped, and a buffer file left
+// behind by an unclean shutdown is recovered and re-enqueued by New on
+// the next restart; see replayBufferDir. Otherwise Put uploads to S3
+// directly and synchronously.
 func (s *s3Impl) Put(ref string, contents []byte) error {
 	const op errors.Op = "cloud/storage/amazons3.Put"
 
-	ul := s3manager.NewUploaderWithClient(s.service)
-	_, err := ul.Upload(&s3manager.UploadInput{
+	if s.bufferDir == "" {
+		if err := s.upload(ref, bytes.NewReader(contents), int64(len(contents))); err != nil {
+			return errors.E(op, errors.IO, errors.Errorf(
+				"unable to upload ref %q to bucket %q: %s", ref, s.bucketName, err))
+		}
+		return nil
+	}
+
+	size := int64(len(contents))
+	f, err := ioutil.TempFile(s.bufferDir, bufferTmpPrefix)
+	if err != nil {
+		return errors.E(op, errors.IO, errors.Errorf("unable to create buffer file: %s", err))
+	}
+	if _, err := f.Write(contents); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return errors.E(op, errors.IO, errors.Errorf("unable to write buffer file: %s", err))
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return errors.E(op, errors.IO, errors.Errorf("unable to write buffer file: %s", err))
+	}
+
+	// Rename into a name that encodes ref, so a restart after an unclean
+	// shutdown can recover the ref to upload this file under; see
+	// replayBufferDir. The tmp prefix keeps partially-written files,
+	// which haven't reached this rename, out of that recovery scan.
+	// uniqueID reuses the random suffix ioutil.TempFile already generated,
+	// so two concurrent Puts for the same ref never collide on one path
+	// and race each other's uploadWorker into deleting the wrong file.
+	uniqueID := strings.TrimPrefix(filepath.Base(f.Name()), bufferTmpPrefix)
+	path := bufferFilePath(s.bufferDir, ref, uniqueID)
+	if err := os.Rename(f.Name(), path); err != nil {
+		os.Remove(f.Name())
+		return errors.E(op, errors.IO, errors.Errorf("unable to stage buffer file: %s", err))
+	}
+
+	if err := s.acquireBudget(size); err != nil {
+		os.Remove(path)
+		return errors.E(op, errors.Invalid, err)
+	}
+	atomic.AddInt64(&s.queueDepth, 1)
+	s.jobs.Add(1)
+	s.work <- &uploadJob{ref: ref, path: path, size: size}
+	return nil
+}
+
+// bufferTmpPrefix names buffer files still being written; replayBufferDir
+// skips them since they have no recoverable ref until Put renames them to
+// their bufferFilePath name.
+const bufferTmpPrefix = ".s3-upload-tmp-"
+
+// bufferFilePrefix and bufferFileSuffix define the on-disk name a
+// fully-staged buffer file is renamed to: the ref, URL-safe base64
+// encoded so it can be recovered by parseBufferFileName after a restart,
+// followed by the uniqueID that keeps two staged files for the same ref
+// from colliding on one path.
+const (
+	bufferFilePrefix = "s3-upload-"
+	bufferFileSuffix = ".buf"
+)
+
+// bufferFilePath returns the path a fully-staged buffer file for ref is
+// renamed to. uniqueID distinguishes concurrent Puts for the same ref; the
+// base64-encoded ref and uniqueID are joined by a literal '.', which never
+// appears in the URL-safe base64 alphabet.
+func bufferFilePath(bufferDir, ref, uniqueID string) string {
+	return filepath.Join(bufferDir, bufferFilePrefix+base64.RawURLEncoding.EncodeToString([]byte(ref))+"."+uniqueID+bufferFileSuffix)
+}
+
+// parseBufferFileName recovers the ref a buffer file was staged for from
+// its name, as produced by bufferFilePath. It reports false for names
+// that aren't staged buffer files, such as bufferTmpPrefix-named files
+// still being written.
+func parseBufferFileName(name string) (ref string, ok bool) {
+	if !strings.HasPrefix(name, bufferFilePrefix) || !strings.HasSuffix(name, bufferFileSuffix) {
+		return "", false
+	}
+	rest := strings.TrimSuffix(strings.TrimPrefix(name, bufferFilePrefix), bufferFileSuffix)
+	encoded := rest
+	if i := strings.IndexByte(rest, '.'); i >= 0 {
+		encoded = rest[:i]
+	}
+	decoded, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", false
+	}
+	return string(decoded), true
+}
+
+// uploadJob is a single buffered upload awaiting its turn on a worker.
+type uploadJob struct {
+	ref  string
+	path string
+	size int64
+}
+
+// uploadWorker uploads queued jobs to S3 until s.work is closed, retrying
+// transient failures with exponential backoff.
+func (s *s3Impl) uploadWorker() {
+	for job := range s.work {
+		err := retryWithBackoff(func() error {
+			f, err := os.Open(job.path)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			return s.upload(job.ref, f, job.size)
+		}, func() { atomic.AddInt64(&s.retries, 1) })
+
+		if err != nil {
+			atomic.AddInt64(&s.permanentFailures, 1)
+			log.Printf("cloud/storage/amazons3: giving up uploading ref %q to bucket %q: %s", job.ref, s.bucketName, err)
+		}
+
+		os.Remove(job.path)
+		s.releaseBudget(job.size)
+		atomic.AddInt64(&s.queueDepth, -1)
+		s.jobs.Done()
+	}
+}
+
+// upload sends contents to S3 under ref, applying the configured ACL and
+// server-side encryption settings. size is unused by upload itself but
+// documents the caller's expectation that contents yields exactly that
+// many bytes.
+func (s *s3Impl) upload(ref string, contents io.Reader, size int64) error {
+	input := &s3manager.UploadInput{
 		ACL:    aws.String(s.defaultWriteACL),
 		Bucket: aws.String(s.bucketName),
 		Key:    aws.String(ref),
-		Body:   bytes.NewBuffer(contents),
+		Body:   contents,
+	}
+	if s.sse != "" {
+		input.ServerSideEncryption = aws.String(s.sse)
+		if s.sse == SSEKMS {
+			input.SSEKMSKeyId = aws.String(s.kmsKeyID)
+		}
+	}
+
+	ul := s3manager.NewUploaderWithClient(s.service, func(u *s3manager.Uploader) {
+		if s.uploadConcurrency > 0 {
+			u.Concurrency = s.uploadConcurrency
+		}
+		if s.uploadPartSize > 0 {
+			u.PartSize = s.uploadPartSize
+		}
 	})
-	if err != nil {
-		return errors.E(op, errors.IO, errors.Errorf(
-			"unable to upload ref %q to bucket %q: %s", ref, s.bucketName, err))
+	_, err := ul.Upload(input)
+	return err
+}
+
+// acquireBudget blocks until there is room for size more bytes in flight,
+// then reserves it. It is a no-op when no buffer byte limit was
+// configured. It returns an error, without blocking, if size alone
+// exceeds the configured limit: no amount of draining would ever make
+// room for it, so waiting would block the caller forever.
+func (s *s3Impl) acquireBudget(size int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.bufferMaxBytes > 0 && size > s.bufferMaxBytes {
+		return errors.Errorf("item of %d bytes exceeds s3BufferMaxBytes (%d)", size, s.bufferMaxBytes)
 	}
+	for s.bufferMaxBytes > 0 && s.bytesInFlight+size > s.bufferMaxBytes {
+		s.cond.Wait()
+	}
+	s.bytesInFlight += size
 	return nil
 }
 
+// releaseBudget returns size bytes to the in-flight budget, waking any
+// Put calls waiting in acquireBudget.
+func (s *s3Impl) releaseBudget(size int64) {
+	s.mu.Lock()
+	s.bytesInFlight -= size
+	s.mu.Unlock()
+	s.cond.Broadcast()
+}
+
+// UploadStats reports the current state of the buffered upload path, for
+// exporting as Prometheus gauges and counters. It is always zero when the
+// backend was dialed without s3BufferDir.
+type UploadStats struct {
+	QueueDepth        int64 // jobs waiting for or undergoing upload.
+	BytesInFlight     int64 // bytes staged on disk or mid-upload.
+	Retries           int64 // cumulative count of retried upload attempts.
+	PermanentFailures int64 // cumulative count of jobs that exhausted retries and were dropped.
+}
+
+// UploadStats returns a snapshot of the buffered upload path's stats.
+func (s *s3Impl) UploadStats() UploadStats {
+	s.mu.Lock()
+	bytesInFlight := s.bytesInFlight
+	s.mu.Unlock()
+	return UploadStats{
+		QueueDepth:        atomic.LoadInt64(&s.queueDepth),
+		BytesInFlight:     bytesInFlight,
+		Retries:           atomic.LoadInt64(&s.retries),
+		PermanentFailures: atomic.LoadInt64(&s.permanentFailures),
+	}
+}
+
 // Delete implements Storage.
 func (s *s3Impl) Delete(ref string) error {
 	const op errors.Op = "cloud/storage/amazons3.Delete"
@@ -168,9 +558,129 @@ func (s *s3Impl) Delete(ref string) error {
 	return nil
 }
 
-// Close implements Storage.
+// DeleteBatch deletes many refs in as few round trips as possible, grouping
+// them into requests of at most maxDeleteBatch keys each. It returns the
+// refs that were deleted and, separately, one error per ref that failed to
+// delete. A ref reported missing by S3 is not counted as deleted; its error
+// is of kind errors.NotExist.
+func (s *s3Impl) DeleteBatch(refs []string) (deleted []string, errs []error) {
+	const op errors.Op = "cloud/storage/amazons3.DeleteBatch"
+
+	for _, chunk := range chunkRefs(refs, maxDeleteBatch) {
+		objects := make([]*s3.ObjectIdentifier, len(chunk))
+		for i, ref := range chunk {
+			objects[i] = &s3.ObjectIdentifier{Key: aws.String(ref)}
+		}
+
+		var out *s3.DeleteObjectsOutput
+		err := retryWithBackoff(func() error {
+			var err error
+			out, err = s.service.DeleteObjects(&s3.DeleteObjectsInput{
+				Bucket: aws.String(s.bucketName),
+				Delete: &s3.Delete{
+					Objects: objects,
+					Quiet:   aws.Bool(true),
+				},
+			})
+			return err
+		}, nil)
+		if err != nil {
+			for _, ref := range chunk {
+				errs = append(errs, errors.E(op, errors.IO, errors.Errorf(
+					"unable to delete ref %q from bucket %q: %s", ref, s.bucketName, err)))
+			}
+			continue
+		}
+
+		failed := make(map[string]bool, len(out.Errors))
+		for _, e := range out.Errors {
+			kind := deleteErrorKind(aws.StringValue(e.Code))
+			errs = append(errs, errors.E(op, kind, errors.Errorf(
+				"unable to delete ref %q from bucket %q: %s", aws.StringValue(e.Key), s.bucketName, aws.StringValue(e.Message))))
+			failed[aws.StringValue(e.Key)] = true
+		}
+		for _, ref := range chunk {
+			if !failed[ref] {
+				deleted = append(deleted, ref)
+			}
+		}
+	}
+	return deleted, errs
+}
+
+// deleteErrorKind maps the per-key error code returned by S3 in a
+// DeleteObjects response to the errors.Kind that best describes it.
+func deleteErrorKind(code string) errors.Kind {
+	if code == s3.ErrCodeNoSuchKey {
+		return errors.NotExist
+	}
+	return errors.IO
+}
+
+// chunkRefs splits refs into slices of at most size elements each.
+func chunkRefs(refs []string, size int) [][]string {
+	var chunks [][]string
+	for len(refs) > 0 {
+		n := size
+		if n > len(refs) {
+			n = len(refs)
+		}
+		chunks = append(chunks, refs[:n])
+		refs = refs[n:]
+	}
+	return chunks
+}
+
+// retryWithBackoff calls fn, retrying transient S3 errors (throttling and
+// 5xx server errors) a few times with exponential backoff. If onRetry is
+// non-nil, it is called once before each retry.
+func retryWithBackoff(fn func() error, onRetry func()) error {
+	const maxAttempts = 4
+	backoff := 100 * time.Millisecond
+	var err error
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		err = fn()
+		if err == nil || !isTransient(err) {
+			return err
+		}
+		if attempt == maxAttempts-1 {
+			break
+		}
+		if onRetry != nil {
+			onRetry()
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+	return err
+}
+
+// isTransient reports whether err is worth retrying: request throttling or
+// a 5xx response from S3.
+func isTransient(err error) bool {
+	awsErr, ok := err.(awserr.RequestFailure)
+	if !ok {
+		return false
+	}
+	if awsErr.StatusCode() >= 500 {
+		return true
+	}
+	switch awsErr.Code() {
+	case "RequestLimitExceeded", "Throttling", "ThrottlingException", "SlowDown":
+		return true
+	}
+	return false
+}
+
+// Close implements Storage. If the backend was dialed with s3BufferDir
+// set, Close blocks until all in-flight uploads have drained.
 func (s *s3Impl) Close() {
-	// Not much to do, the S3 service doesnâ€™t require any cleanup.
+	if s.work != nil {
+		close(s.work)
+		s.jobs.Wait()
+	}
 	s.service = nil
 	s.bucketName = ""
+	s.sse = ""
+	s.kmsKeyID = ""
 }
@@ -4,13 +4,18 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/s3"
 
 	"upspin.io/cloud/storage"
+	"upspin.io/errors"
 	"upspin.io/log"
 )
 
@@ -34,6 +39,9 @@ var (
 // storage in prod. However, since S3 is always available, we accept
 // relying on it.
 func TestPutAndDownload(t *testing.T) {
+	if !*useAWS {
+		t.Skip("skipping test that requires S3 access; set -use_aws to enable")
+	}
 	err := client.Put(fileName, testData)
 	if err != nil {
 		t.Fatalf("Can't put: %v", err)
@@ -48,6 +56,9 @@ func TestPutAndDownload(t *testing.T) {
 }
 
 func TestDelete(t *testing.T) {
+	if !*useAWS {
+		t.Skip("skipping test that requires S3 access; set -use_aws to enable")
+	}
 	err := client.Put(fileName, testData)
 	if err != nil {
 		t.Fatal(err)
@@ -68,12 +79,13 @@ func TestMain(m *testing.M) {
 	if !*useAWS {
 		log.Printf(`
 
-cloud/storage/amazons3: skipping test as it requires S3 access. To enable this
-test, ensure you are properly authorized to upload to an S3 bucket named by flag
--test_bucket and then set this test's flag -use_aws.
+cloud/storage/amazons3: skipping tests that require S3 access. To enable them,
+ensure you are properly authorized to upload to an S3 bucket named by flag
+-test_bucket and then set this test's flag -use_aws. Tests that exercise pure
+logic still run.
 
 `)
-		os.Exit(0)
+		os.Exit(m.Run())
 	}
 
 	// Create client that writes to test bucket.
@@ -108,3 +120,154 @@ func (s *s3Impl) deleteBucket() error {
 	_, err := s.service.DeleteBucket(&s3.DeleteBucketInput{Bucket: aws.String(s.bucketName)})
 	return err
 }
+
+func TestBufferFileNameRoundTrip(t *testing.T) {
+	refs := []string{"simple-ref", "ref/with/slashes", "ref with spaces", ""}
+	for _, ref := range refs {
+		path := bufferFilePath("/buf", ref, "abc123")
+		name := filepath.Base(path)
+		got, ok := parseBufferFileName(name)
+		if !ok {
+			t.Errorf("parseBufferFileName(%q) for ref %q: ok = false, want true", name, ref)
+			continue
+		}
+		if got != ref {
+			t.Errorf("parseBufferFileName(%q) = %q, want %q", name, got, ref)
+		}
+	}
+}
+
+func TestBufferFileNameUniqueIDAvoidsCollision(t *testing.T) {
+	p1 := bufferFilePath("/buf", "same-ref", "id1")
+	p2 := bufferFilePath("/buf", "same-ref", "id2")
+	if p1 == p2 {
+		t.Fatalf("bufferFilePath produced the same path for two different uniqueIDs: %q", p1)
+	}
+}
+
+func TestParseBufferFileNameIgnoresTmpFiles(t *testing.T) {
+	if _, ok := parseBufferFileName(bufferTmpPrefix + "123456"); ok {
+		t.Errorf("parseBufferFileName recognized an in-progress tmp file as a staged buffer file")
+	}
+}
+
+func TestChunkRefs(t *testing.T) {
+	cases := []struct {
+		refs []string
+		size int
+		want [][]string
+	}{
+		{nil, 2, nil},
+		{[]string{"a"}, 2, [][]string{{"a"}}},
+		{[]string{"a", "b"}, 2, [][]string{{"a", "b"}}},
+		{[]string{"a", "b", "c"}, 2, [][]string{{"a", "b"}, {"c"}}},
+		{[]string{"a", "b", "c", "d"}, 2, [][]string{{"a", "b"}, {"c", "d"}}},
+	}
+	for _, c := range cases {
+		got := chunkRefs(c.refs, c.size)
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("chunkRefs(%v, %d) = %v, want %v", c.refs, c.size, got, c.want)
+		}
+	}
+}
+
+func TestIsTransient(t *testing.T) {
+	cases := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"non-aws error", fmt.Errorf("boom"), false},
+		{"500", awserr.NewRequestFailure(awserr.New("InternalError", "internal error", nil), 500, "req-1"), true},
+		{"503", awserr.NewRequestFailure(awserr.New("ServiceUnavailable", "unavailable", nil), 503, "req-2"), true},
+		{"404 not found", awserr.NewRequestFailure(awserr.New(s3.ErrCodeNoSuchKey, "no such key", nil), 404, "req-3"), false},
+		{"throttling", awserr.NewRequestFailure(awserr.New("Throttling", "slow down", nil), 400, "req-4"), true},
+		{"request limit exceeded", awserr.NewRequestFailure(awserr.New("RequestLimitExceeded", "too many requests", nil), 400, "req-5"), true},
+		{"other 4xx", awserr.NewRequestFailure(awserr.New("AccessDenied", "denied", nil), 403, "req-6"), false},
+	}
+	for _, c := range cases {
+		if got := isTransient(c.err); got != c.want {
+			t.Errorf("isTransient(%s) = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestDeleteErrorKind(t *testing.T) {
+	cases := []struct {
+		code string
+		want errors.Kind
+	}{
+		{s3.ErrCodeNoSuchKey, errors.NotExist},
+		{"AccessDenied", errors.IO},
+		{"", errors.IO},
+	}
+	for _, c := range cases {
+		if got := deleteErrorKind(c.code); got != c.want {
+			t.Errorf("deleteErrorKind(%q) = %v, want %v", c.code, got, c.want)
+		}
+	}
+}
+
+// TestAcquireBudgetDeadlock guards against a regression of the deadlock
+// where a single Put larger than bufferMaxBytes would block forever in
+// acquireBudget: no upload had been admitted yet, so nothing would ever
+// call releaseBudget to wake it.
+func TestAcquireBudgetDeadlock(t *testing.T) {
+	s := &s3Impl{bufferMaxBytes: 100}
+	s.cond = sync.NewCond(&s.mu)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- s.acquireBudget(200)
+	}()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("acquireBudget(200) with bufferMaxBytes=100 returned nil, want an error")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("acquireBudget blocked forever on an item larger than bufferMaxBytes")
+	}
+}
+
+// TestAcquireReleaseBudget exercises the normal budget gate under
+// concurrent acquire/release, checking that bytesInFlight never exceeds
+// the configured limit and that every acquirer is eventually admitted.
+func TestAcquireReleaseBudget(t *testing.T) {
+	s := &s3Impl{bufferMaxBytes: 10}
+	s.cond = sync.NewCond(&s.mu)
+
+	const n = 20
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := s.acquireBudget(3); err != nil {
+				t.Errorf("acquireBudget(3): %v", err)
+				return
+			}
+			s.mu.Lock()
+			over := s.bytesInFlight > s.bufferMaxBytes
+			s.mu.Unlock()
+			if over {
+				t.Error("bytesInFlight exceeded bufferMaxBytes")
+			}
+			time.Sleep(time.Millisecond)
+			s.releaseBudget(3)
+		}()
+	}
+
+	doneAll := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(doneAll)
+	}()
+	select {
+	case <-doneAll:
+	case <-time.After(5 * time.Second):
+		t.Fatal("acquire/release budget gate did not drain within 5s")
+	}
+}
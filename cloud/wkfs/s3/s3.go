@@ -0,0 +1,234 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package s3 registers an S3-backed well-known filesystem so that
+// upspin.io/cloud/https can load TLS certificates and keys from an S3 URL
+// (s3://bucket/path) instead of local disk. This lets a fleet of
+// upspinserver-aws instances share a single copy of those files rather
+// than re-copying them to every host. It does not serve serverconfig.json;
+// that file is still read from local disk by upspin.io/serverutil.
+package s3 // import "aws.upspin.io/cloud/wkfs/s3"
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+
+	"upspin.io/cloud/wkfs"
+	"upspin.io/errors"
+)
+
+// Options configures the S3 well-known filesystem. It mirrors the dial
+// options accepted by aws.upspin.io/cloud/storage/s3.
+type Options struct {
+	// Region is the AWS region of the bucket. Required.
+	Region string
+	// Endpoint, if non-empty, overrides the default S3 endpoint for the
+	// region. Useful for S3-compatible services.
+	Endpoint string
+	// PathStyle forces path-style bucket addressing instead of the
+	// default virtual-hosted style.
+	PathStyle bool
+}
+
+// Register establishes the "s3" well-known filesystem using the given
+// options. It must be called before any s3://... name is resolved, for
+// instance before upspin.io/cloud/https.ListenAndServeFromFlags reads its
+// certificate and key.
+func Register(opts *Options) error {
+	const op errors.Op = "cloud/wkfs/s3.Register"
+
+	if opts == nil || opts.Region == "" {
+		return errors.E(op, errors.Invalid, errors.Str("a region must be provided"))
+	}
+
+	config := aws.Config{
+		Region:           aws.String(opts.Region),
+		S3ForcePathStyle: aws.Bool(opts.PathStyle),
+	}
+	if opts.Endpoint != "" {
+		config.Endpoint = aws.String(opts.Endpoint)
+	}
+
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config:            config,
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return errors.E(op, errors.IO, errors.Errorf("unable to create Amazon session: %s", err))
+	}
+
+	fs := &s3FS{service: s3.New(sess)}
+	wkfs.RegisterFS("s3", fs)
+	return nil
+}
+
+// s3FS implements upspin.io/cloud/wkfs.FS for S3-backed names of the form
+// "s3://bucket/key".
+type s3FS struct {
+	service *s3.S3
+}
+
+// parse splits a wkfs name of the form "s3://bucket/key" into its bucket
+// and key parts.
+func parse(op errors.Op, name string) (bucket, key string, err error) {
+	const prefix = "s3://"
+	if !strings.HasPrefix(name, prefix) {
+		return "", "", errors.E(op, errors.Invalid, errors.Errorf("name %q must begin with %q", name, prefix))
+	}
+	rest := name[len(prefix):]
+	i := strings.IndexByte(rest, '/')
+	if i < 0 || i == 0 || i == len(rest)-1 {
+		return "", "", errors.E(op, errors.Invalid, errors.Errorf("name %q must be of the form %sbucket/key", name, prefix))
+	}
+	return rest[:i], rest[i+1:], nil
+}
+
+// Open implements upspin.io/cloud/wkfs.FS.
+func (f *s3FS) Open(name string) (wkfs.File, error) {
+	const op errors.Op = "cloud/wkfs/s3.Open"
+
+	bucket, key, err := parse(op, name)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := aws.NewWriteAtBuffer(nil)
+	d := s3manager.NewDownloaderWithClient(f.service)
+	if _, err := d.Download(buf, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}); err != nil {
+		if awsErr, ok := err.(awserr.RequestFailure); ok && awsErr.StatusCode() == 404 {
+			return nil, errors.E(op, errors.NotExist, errors.Errorf("%q not found", name))
+		}
+		return nil, errors.E(op, errors.IO, errors.Errorf("unable to read %q: %s", name, err))
+	}
+
+	return &file{
+		name:   name,
+		Reader: bytes.NewReader(buf.Bytes()),
+		size:   int64(len(buf.Bytes())),
+	}, nil
+}
+
+// Stat implements upspin.io/cloud/wkfs.FS.
+func (f *s3FS) Stat(name string) (os.FileInfo, error) {
+	const op errors.Op = "cloud/wkfs/s3.Stat"
+
+	bucket, key, err := parse(op, name)
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := f.service.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		if awsErr, ok := err.(awserr.RequestFailure); ok && awsErr.StatusCode() == 404 {
+			return nil, errors.E(op, errors.NotExist, err)
+		}
+		return nil, errors.E(op, errors.IO, errors.Errorf("unable to stat %q: %s", name, err))
+	}
+
+	info := &fileInfo{name: key}
+	if out.ContentLength != nil {
+		info.size = *out.ContentLength
+	}
+	if out.LastModified != nil {
+		info.modTime = *out.LastModified
+	}
+	return info, nil
+}
+
+// Create implements upspin.io/cloud/wkfs.FS.
+func (f *s3FS) Create(name string) (wkfs.File, error) {
+	const op errors.Op = "cloud/wkfs/s3.Create"
+
+	bucket, key, err := parse(op, name)
+	if err != nil {
+		return nil, err
+	}
+
+	pr, pw := io.Pipe()
+	w := &writer{name: name, PipeWriter: pw, done: make(chan error, 1)}
+
+	go func() {
+		ul := s3manager.NewUploaderWithClient(f.service)
+		_, err := ul.Upload(&s3manager.UploadInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+			Body:   pr,
+		})
+		pr.CloseWithError(err)
+		w.done <- err
+	}()
+
+	return w, nil
+}
+
+// file implements upspin.io/cloud/wkfs.File for a fully-buffered read of an
+// S3 object.
+type file struct {
+	name string
+	*bytes.Reader
+	size int64
+}
+
+func (fl *file) Close() error { return nil }
+
+func (fl *file) Stat() (os.FileInfo, error) {
+	return &fileInfo{name: fl.name, size: fl.size}, nil
+}
+
+// writer implements upspin.io/cloud/wkfs.File for writes, streaming the
+// written bytes straight into an s3manager upload running in the
+// background.
+type writer struct {
+	name string
+	*io.PipeWriter
+	done chan error
+}
+
+func (w *writer) Close() error {
+	if err := w.PipeWriter.Close(); err != nil {
+		return err
+	}
+	if err := <-w.done; err != nil {
+		return errors.E(errors.Op("cloud/wkfs/s3.Create"), errors.IO, errors.Errorf("unable to upload %q: %s", w.name, err))
+	}
+	return nil
+}
+
+func (w *writer) Read([]byte) (int, error) {
+	return 0, fmt.Errorf("cloud/wkfs/s3: %q is write-only", w.name)
+}
+
+func (w *writer) Stat() (os.FileInfo, error) {
+	return nil, fmt.Errorf("cloud/wkfs/s3: cannot stat %q before it is closed", w.name)
+}
+
+// fileInfo is a minimal os.FileInfo for S3 objects.
+type fileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func (fi *fileInfo) Name() string       { return fi.name }
+func (fi *fileInfo) Size() int64        { return fi.size }
+func (fi *fileInfo) Mode() os.FileMode  { return 0644 }
+func (fi *fileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *fileInfo) IsDir() bool        { return false }
+func (fi *fileInfo) Sys() interface{}   { return nil }
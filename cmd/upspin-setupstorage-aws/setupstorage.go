@@ -8,11 +8,13 @@
 package main // import "aws.upspin.io/cmd/upspin-setupstorage-aws"
 
 import (
+	"bytes"
 	"flag"
 	"fmt"
 	"log"
 	"os"
 	"path/filepath"
+	"text/template"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
@@ -20,9 +22,42 @@ import (
 	"github.com/aws/aws-sdk-go/service/iam"
 	"github.com/aws/aws-sdk-go/service/s3"
 
+	awss3 "aws.upspin.io/cloud/storage/s3"
 	"upspin.io/subcmd"
 )
 
+// rolePolicyName is the name given to the inline role policy that scopes
+// access to the bucket created by this command.
+const rolePolicyName = "upspin-bucket-access-policy"
+
+// bucketPolicyTemplate generates an IAM policy document that grants only the
+// S3 actions the storage backend uses, scoped to a single bucket.
+var bucketPolicyTemplate = template.Must(template.New("bucketPolicy").Parse(`{
+	"Version": "2012-10-17",
+	"Statement": [
+		{
+			"Effect": "Allow",
+			"Action": [
+				"s3:GetObject",
+				"s3:PutObject",
+				"s3:DeleteObject",
+				"s3:AbortMultipartUpload",
+				"s3:ListMultipartUploadParts"
+			],
+			"Resource": "arn:aws:s3:::{{.Bucket}}/*"
+		},
+		{
+			"Effect": "Allow",
+			"Action": [
+				"s3:ListBucket",
+				"s3:ListBucketMultipartUploads",
+				"s3:GetBucketLocation"
+			],
+			"Resource": "arn:aws:s3:::{{.Bucket}}"
+		}
+	]
+}`))
+
 type state struct {
 	*subcmd.State
 	sess *session.Session
@@ -45,6 +80,17 @@ http://docs.aws.amazon.com/cli/latest/userguide/cli-chap-getting-set-up.html
 If something goes wrong during the setup process, you can run the same command
 with the -clean flag. It will attempt to remove any entities previously created
 with the same options provided.
+
+If you need to tighten or regenerate the bucket access policy on a role that
+already exists, run with -policy_only. It regenerates the inline policy
+scoped to the given bucket and re-attaches it to -role_name without touching
+anything else.
+
+Use -versioning, -transition_days/-transition_class, -expire_noncurrent_days,
+and -cors_origin to provision the bucket for production use: versioning
+protects against accidental deletes, the lifecycle flags move old objects to
+cheaper storage tiers and expire noncurrent versions, and -cors_origin lets
+browsers fetch public-read blocks directly from the bucket.
 `
 
 func main() {
@@ -65,11 +111,21 @@ func main() {
 	}
 
 	var (
-		where    = flag.String("where", filepath.Join(os.Getenv("HOME"), "upspin", "deploy"), "`directory` to store private configuration files")
-		domain   = flag.String("domain", "", "domain `name` for this Upspin installation")
-		region   = flag.String("region", "us-east-1", "region for the S3 bucket")
-		roleName = flag.String("role_name", "upspinstorage", "name for the IAM Role used to access the S3 bucket")
-		clean    = flag.Bool("clean", false, "deletes all artifacts that would be created using this command")
+		where      = flag.String("where", filepath.Join(os.Getenv("HOME"), "upspin", "deploy"), "`directory` to store private configuration files")
+		domain     = flag.String("domain", "", "domain `name` for this Upspin installation")
+		region     = flag.String("region", "us-east-1", "region for the S3 bucket")
+		roleName   = flag.String("role_name", "upspinstorage", "name for the IAM Role used to access the S3 bucket")
+		clean      = flag.Bool("clean", false, "deletes all artifacts that would be created using this command")
+		policyOnly = flag.Bool("policy_only", false, "regenerate and re-attach the bucket access policy on an existing role, then exit")
+		acl        = flag.String("acl", awss3.ACLPublicRead, "canned ACL applied to objects written to the bucket")
+		sse        = flag.String("sse", "", `server-side encryption mode for the bucket: "", "`+awss3.SSES3+`", or "`+awss3.SSEKMS+`"`)
+		kmsKeyID   = flag.String("kms_key_id", "", "KMS key ID or ARN to use when -sse="+awss3.SSEKMS)
+
+		versioning           = flag.Bool("versioning", false, "enable bucket versioning so deleted blocks can be recovered")
+		transitionDays       = flag.Int("transition_days", 0, "if positive, number of days after which objects transition to -transition_class")
+		transitionClass      = flag.String("transition_class", s3.TransitionStorageClassStandardIa, "storage class used by -transition_days")
+		expireNoncurrentDays = flag.Int("expire_noncurrent_days", 0, "if positive, number of days after which noncurrent object versions expire")
+		corsOrigin           = flag.String("cors_origin", "", "if set, allowed `origin` for a CORS rule permitting GET requests to the bucket")
 	)
 
 	s.ParseFlags(flag.CommandLine, os.Args[1:], help,
@@ -77,8 +133,18 @@ func main() {
 	if flag.NArg() != 1 {
 		s.Exitf("a single bucket name must be provided")
 	}
-	if len(*domain) == 0 {
-		s.Exitf("the -domain flag must be provided")
+
+	switch *sse {
+	case "", awss3.SSES3, awss3.SSEKMS:
+		// OK.
+	default:
+		s.Exitf("-sse must be empty, %q, or %q", awss3.SSES3, awss3.SSEKMS)
+	}
+	if *sse == awss3.SSEKMS && *kmsKeyID == "" {
+		s.Exitf("-kms_key_id is required when -sse=%s", awss3.SSEKMS)
+	}
+	if *transitionDays < 0 || *expireNoncurrentDays < 0 {
+		s.Exitf("-transition_days and -expire_noncurrent_days must not be negative")
 	}
 
 	bucketName := flag.Arg(0)
@@ -87,6 +153,22 @@ func main() {
 		s.ExitNow()
 	}
 
+	if *policyOnly {
+		role, err := s.getRoleAccount(*roleName)
+		if err != nil {
+			s.Exitf("unable to find role account: %s", err)
+		}
+		if err := s.putRolePolicy(role, bucketName); err != nil {
+			s.Exitf("unable to update role policy: %s", err)
+		}
+		fmt.Fprintf(os.Stderr, "Role policy for %q updated to scope access to bucket %q.\n", *roleName, bucketName)
+		s.ExitNow()
+	}
+
+	if len(*domain) == 0 {
+		s.Exitf("the -domain flag must be provided")
+	}
+
 	cfgPath := filepath.Join(*where, *domain)
 	cfg := s.ReadServerConfig(cfgPath)
 
@@ -103,15 +185,41 @@ func main() {
 		s.Exitf("unable to create S3 bucket: %s", err)
 	}
 
-	if err := s.attachRolePolicy(role, bucketName); err != nil {
+	if *sse != "" {
+		if err := s.putBucketEncryption(*region, bucketName, *sse, *kmsKeyID); err != nil {
+			s.Exitf("unable to set default bucket encryption: %s", err)
+		}
+	}
+
+	if *versioning {
+		if err := s.putBucketVersioning(*region, bucketName); err != nil {
+			s.Exitf("unable to enable bucket versioning: %s", err)
+		}
+	}
+
+	if *transitionDays > 0 || *expireNoncurrentDays > 0 {
+		if err := s.putBucketLifecycle(*region, bucketName, *transitionDays, *transitionClass, *expireNoncurrentDays); err != nil {
+			s.Exitf("unable to set bucket lifecycle configuration: %s", err)
+		}
+	}
+
+	if *corsOrigin != "" {
+		if err := s.putBucketCORS(*region, bucketName, *corsOrigin); err != nil {
+			s.Exitf("unable to set bucket CORS configuration: %s", err)
+		}
+	}
+
+	if err := s.putRolePolicy(role, bucketName); err != nil {
 		s.Exitf("unable to attach role policy: %s", err)
 	}
 
 	cfg.StoreConfig = []string{
 		"backend=S3",
-		"defaultACL=public-read",
+		"defaultACL=" + *acl,
 		"s3BucketName=" + bucketName,
 		"s3Region=" + *region,
+		"s3SSE=" + *sse,
+		"s3KMSKeyID=" + *kmsKeyID,
 	}
 	s.WriteServerConfig(cfgPath, cfg)
 
@@ -160,11 +268,30 @@ func (s *state) createInstanceProfile(role *iam.Role) error {
 	return err
 }
 
-func (s *state) attachRolePolicy(role *iam.Role, bucketName string) error {
+func (s *state) getRoleAccount(name string) (*iam.Role, error) {
 	svc := iam.New(s.sess)
-	_, err := svc.AttachRolePolicy(&iam.AttachRolePolicyInput{
-		PolicyArn: aws.String("arn:aws:iam::aws:policy/AmazonS3FullAccess"),
-		RoleName:  role.RoleName,
+	output, err := svc.GetRole(&iam.GetRoleInput{
+		RoleName: aws.String(name),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return output.Role, nil
+}
+
+// putRolePolicy generates an inline IAM policy, scoped to bucketName, and
+// attaches it to role, replacing any previous version of the policy.
+func (s *state) putRolePolicy(role *iam.Role, bucketName string) error {
+	var buf bytes.Buffer
+	if err := bucketPolicyTemplate.Execute(&buf, struct{ Bucket string }{bucketName}); err != nil {
+		return err
+	}
+
+	svc := iam.New(s.sess)
+	_, err := svc.PutRolePolicy(&iam.PutRolePolicyInput{
+		PolicyName:     aws.String(rolePolicyName),
+		PolicyDocument: aws.String(buf.String()),
+		RoleName:       role.RoleName,
 	})
 	return err
 }
@@ -180,6 +307,107 @@ func (s *state) createBucket(role *iam.Role, region, bucketName string) error {
 	return err
 }
 
+// putBucketEncryption applies a default server-side encryption
+// configuration to the bucket so that objects are encrypted at rest even
+// if a future Put call forgets to request it explicitly.
+func (s *state) putBucketEncryption(region, bucketName, sse, kmsKeyID string) error {
+	svc := s3.New(s.sess, &aws.Config{
+		Region: aws.String(region),
+	})
+
+	rule := &s3.ServerSideEncryptionByDefault{
+		SSEAlgorithm: aws.String(sse),
+	}
+	if sse == awss3.SSEKMS {
+		rule.KMSMasterKeyID = aws.String(kmsKeyID)
+	}
+
+	_, err := svc.PutBucketEncryption(&s3.PutBucketEncryptionInput{
+		Bucket: aws.String(bucketName),
+		ServerSideEncryptionConfiguration: &s3.ServerSideEncryptionConfiguration{
+			Rules: []*s3.ServerSideEncryptionRule{
+				{ApplyServerSideEncryptionByDefault: rule},
+			},
+		},
+	})
+	return err
+}
+
+// putBucketVersioning turns on versioning for the bucket so that
+// accidentally-deleted or overwritten Upspin blocks can be recovered.
+func (s *state) putBucketVersioning(region, bucketName string) error {
+	svc := s3.New(s.sess, &aws.Config{
+		Region: aws.String(region),
+	})
+
+	_, err := svc.PutBucketVersioning(&s3.PutBucketVersioningInput{
+		Bucket: aws.String(bucketName),
+		VersioningConfiguration: &s3.VersioningConfiguration{
+			Status: aws.String(s3.BucketVersioningStatusEnabled),
+		},
+	})
+	return err
+}
+
+// putBucketLifecycle installs a lifecycle rule that transitions current
+// objects to a cheaper storage class after transitionDays (if positive)
+// and expires noncurrent object versions after expireNoncurrentDays (if
+// positive).
+func (s *state) putBucketLifecycle(region, bucketName string, transitionDays int, transitionClass string, expireNoncurrentDays int) error {
+	svc := s3.New(s.sess, &aws.Config{
+		Region: aws.String(region),
+	})
+
+	rule := &s3.LifecycleRule{
+		ID:     aws.String("upspin-storage-lifecycle"),
+		Status: aws.String(s3.ExpirationStatusEnabled),
+		Filter: &s3.LifecycleRuleFilter{Prefix: aws.String("")},
+	}
+	if transitionDays > 0 {
+		rule.Transitions = []*s3.Transition{
+			{
+				Days:         aws.Int64(int64(transitionDays)),
+				StorageClass: aws.String(transitionClass),
+			},
+		}
+	}
+	if expireNoncurrentDays > 0 {
+		rule.NoncurrentVersionExpiration = &s3.NoncurrentVersionExpiration{
+			NoncurrentDays: aws.Int64(int64(expireNoncurrentDays)),
+		}
+	}
+
+	_, err := svc.PutBucketLifecycleConfiguration(&s3.PutBucketLifecycleConfigurationInput{
+		Bucket: aws.String(bucketName),
+		LifecycleConfiguration: &s3.BucketLifecycleConfiguration{
+			Rules: []*s3.LifecycleRule{rule},
+		},
+	})
+	return err
+}
+
+// putBucketCORS allows browsers served from corsOrigin to fetch
+// public-read blocks directly from the bucket via LinkBase.
+func (s *state) putBucketCORS(region, bucketName, corsOrigin string) error {
+	svc := s3.New(s.sess, &aws.Config{
+		Region: aws.String(region),
+	})
+
+	_, err := svc.PutBucketCors(&s3.PutBucketCorsInput{
+		Bucket: aws.String(bucketName),
+		CORSConfiguration: &s3.CORSConfiguration{
+			CORSRules: []*s3.CORSRule{
+				{
+					AllowedOrigins: aws.StringSlice([]string{corsOrigin}),
+					AllowedMethods: aws.StringSlice([]string{"GET"}),
+					AllowedHeaders: aws.StringSlice([]string{"*"}),
+				},
+			},
+		},
+	})
+	return err
+}
+
 // clean makes a best-effort attempt at cleaning up entities created by this
 // command. Errors are reported to the user only if it wasn’t due to the entity
 // not being found.
@@ -189,6 +417,33 @@ func (s *state) clean(roleName, bucketName, region string) {
 	s3svc := s3.New(s.sess, &aws.Config{
 		Region: aws.String(region),
 	})
+	// Suspending versioning does not purge any object versions already
+	// written to the bucket; those remain until the bucket itself is
+	// deleted below.
+	if _, err := s3svc.PutBucketVersioning(&s3.PutBucketVersioningInput{
+		Bucket: aws.String(bucketName),
+		VersioningConfiguration: &s3.VersioningConfiguration{
+			Status: aws.String(s3.BucketVersioningStatusSuspended),
+		},
+	}); err != nil {
+		if err.(awserr.RequestFailure).StatusCode() != 404 {
+			log.Printf("unable to suspend bucket versioning for %s: %s", bucketName, err)
+		}
+	}
+	if _, err := s3svc.DeleteBucketLifecycle(&s3.DeleteBucketLifecycleInput{
+		Bucket: aws.String(bucketName),
+	}); err != nil {
+		if err.(awserr.RequestFailure).StatusCode() != 404 {
+			log.Printf("unable to delete bucket lifecycle configuration for %s: %s", bucketName, err)
+		}
+	}
+	if _, err := s3svc.DeleteBucketCors(&s3.DeleteBucketCorsInput{
+		Bucket: aws.String(bucketName),
+	}); err != nil {
+		if err.(awserr.RequestFailure).StatusCode() != 404 {
+			log.Printf("unable to delete bucket CORS configuration for %s: %s", bucketName, err)
+		}
+	}
 	if _, err := s3svc.DeleteBucket(&s3.DeleteBucketInput{
 		Bucket: aws.String(bucketName),
 	}); err != nil {
@@ -215,7 +470,7 @@ func (s *state) clean(roleName, bucketName, region string) {
 	}
 
 	if _, err := iamSvc.DeleteRolePolicy(&iam.DeleteRolePolicyInput{
-		PolicyName: aws.String("upspin-access-policy"),
+		PolicyName: aws.String(rolePolicyName),
 		RoleName:   aws.String(roleName),
 	}); err != nil {
 		if err.(awserr.RequestFailure).StatusCode() != 404 {
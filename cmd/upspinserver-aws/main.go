@@ -9,14 +9,37 @@
 package main // import "aws.upspin.io/cmd/upspinserver-aws"
 
 import (
+	"flag"
+	"log"
+
 	"upspin.io/cloud/https"
 	"upspin.io/serverutil/upspinserver"
 
 	// Storage on S3.
 	_ "aws.upspin.io/cloud/storage/s3"
+
+	wkfss3 "aws.upspin.io/cloud/wkfs/s3"
+)
+
+var (
+	wkfsKind        = flag.String("wkfs", "", "if set to \"s3\", read TLS certificates and keys from the s3:// well-known filesystem; server config is still read from local disk")
+	wkfsS3Region    = flag.String("wkfs_s3_region", "", "AWS region of the bucket used by -wkfs=s3")
+	wkfsS3Endpoint  = flag.String("wkfs_s3_endpoint", "", "optional S3-compatible endpoint used by -wkfs=s3")
+	wkfsS3Pathstyle = flag.Bool("wkfs_s3_pathstyle", false, "use path-style bucket addressing for -wkfs=s3")
 )
 
 func main() {
 	ready := upspinserver.Main()
+
+	if *wkfsKind == "s3" {
+		if err := wkfss3.Register(&wkfss3.Options{
+			Region:    *wkfsS3Region,
+			Endpoint:  *wkfsS3Endpoint,
+			PathStyle: *wkfsS3Pathstyle,
+		}); err != nil {
+			log.Fatalf("upspinserver-aws: wkfs: %v", err)
+		}
+	}
+
 	https.ListenAndServe(ready, https.OptionsFromFlags())
 }